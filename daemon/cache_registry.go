@@ -0,0 +1,136 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/context"
+
+	distclient "github.com/docker/distribution"
+	dockerdist "github.com/docker/docker/distribution"
+	"github.com/docker/docker/image/cache"
+	"github.com/docker/docker/reference"
+	"github.com/docker/docker/registry"
+)
+
+// ErrCacheFromTrustFailed is returned by resolveRegistryCacheSource when name
+// resolves to a registry reference but fails content trust verification.
+// It's kept distinct from resolveRegistryCacheSource's other error cases so
+// that a caller can refuse to silently fall back to "no cache hit" the way
+// it would for a merely-missing --cache-from source: an operator who didn't
+// pass --cache-from-insecure has asked for trust to be enforced, and a
+// failed check on a cache source should stop the build, not just quietly
+// warn and proceed without it.
+type ErrCacheFromTrustFailed struct {
+	Ref string
+	Err error
+}
+
+func (e ErrCacheFromTrustFailed) Error() string {
+	return fmt.Sprintf("cache-from %s: %v (use --cache-from-insecure to override)", e.Ref, e.Err)
+}
+
+// resolveRegistryCacheSource treats name as a registry reference (as
+// opposed to a local image name or ID) and, if it resolves, returns a
+// cache.RegistryCache for it. ok is false if name doesn't look like a
+// registry reference at all, so the caller can fall back to its usual
+// "not a local image either" handling.
+//
+// Unless insecure is set, the resolved manifest is required to match what
+// was signed into the repository's TUF targets role -- refusing to use an
+// unsigned or tampered-with image as a --cache-from source, the same way a
+// normal `docker pull` with content trust enabled would.
+func (daemon *Daemon) resolveRegistryCacheSource(name string, insecure bool) (source cache.Source, ok bool, err error) {
+	ref, err := reference.ParseNamed(name)
+	if err != nil {
+		return nil, false, nil
+	}
+	tagged, isTagged := reference.WithDefaultTag(ref).(reference.NamedTagged)
+	if !isTagged {
+		return nil, false, nil
+	}
+
+	repoInfo, err := daemon.RegistryService.ResolveRepository(ref)
+	if err != nil {
+		return nil, true, err
+	}
+	endpoints, err := daemon.RegistryService.LookupPullEndpoints(repoInfo.Hostname())
+	if err != nil {
+		return nil, true, err
+	}
+	if len(endpoints) == 0 {
+		return nil, true, fmt.Errorf("cache-from %s: no registry endpoints found", name)
+	}
+
+	ctx := context.Background()
+	repo, err := newCacheRepository(ctx, repoInfo, endpoints[0])
+	if err != nil {
+		return nil, true, err
+	}
+
+	// Resolve the tag to a manifest digest exactly once, here, and use that
+	// same digest both for trust verification and for the actual manifest
+	// fetch inside RegistryCache: verifying one digest but having
+	// RegistryCache re-resolve the tag independently would leave a window
+	// for the tag to move between the two lookups.
+	desc, err := repo.Tags(ctx).Get(ctx, tagged.Tag())
+	if err != nil {
+		return nil, true, fmt.Errorf("cache-from %s: resolving manifest digest: %v", name, err)
+	}
+
+	if !insecure {
+		if err := verifyCacheFromTrust(tagged, desc.Digest, fetchNotaryTargets); err != nil {
+			return nil, true, ErrCacheFromTrustFailed{Ref: name, Err: err}
+		}
+	}
+
+	return cache.NewRegistry(daemon.imageStore, daemon.layerStore, repo, tagged, desc.Digest), true, nil
+}
+
+// PushImageCache pushes the image identified by imgID to cacheTo as a cache
+// manifest, so a later build (on this daemon or elsewhere) can use cacheTo
+// as a --cache-from source. It is the write side of
+// resolveRegistryCacheSource, and is what the builder is expected to call,
+// once per --cache-to reference, after a build completes successfully.
+func (daemon *Daemon) PushImageCache(cacheTo string, imgID string) error {
+	ref, err := reference.ParseNamed(cacheTo)
+	if err != nil {
+		return fmt.Errorf("cache-to %s: %v", cacheTo, err)
+	}
+	tagged, isTagged := reference.WithDefaultTag(ref).(reference.NamedTagged)
+	if !isTagged {
+		return fmt.Errorf("cache-to %s: not a valid tagged reference", cacheTo)
+	}
+
+	img, err := daemon.GetImage(imgID)
+	if err != nil {
+		return err
+	}
+
+	repoInfo, err := daemon.RegistryService.ResolveRepository(ref)
+	if err != nil {
+		return err
+	}
+	endpoints, err := daemon.RegistryService.LookupPushEndpoints(repoInfo.Hostname())
+	if err != nil {
+		return err
+	}
+	if len(endpoints) == 0 {
+		return fmt.Errorf("cache-to %s: no registry endpoints found", cacheTo)
+	}
+
+	ctx := context.Background()
+	repo, err := newCacheRepository(ctx, repoInfo, endpoints[0])
+	if err != nil {
+		return err
+	}
+
+	return cache.PushCacheManifest(repo, tagged, img)
+}
+
+// newCacheRepository opens a read/write distribution.Repository client for
+// repoInfo at endpoint, the same way the puller/pusher do, so cache
+// manifests travel over the registry's normal v2 API and credentials.
+func newCacheRepository(ctx context.Context, repoInfo *registry.RepositoryInfo, endpoint registry.APIEndpoint) (distclient.Repository, error) {
+	return dockerdist.NewV2Repository(ctx, repoInfo, endpoint, http.Header{}, nil, "pull", "push")
+}
@@ -0,0 +1,71 @@
+package daemon
+
+import (
+	"fmt"
+
+	"github.com/docker/distribution/digest"
+	notaryclient "github.com/docker/notary/client"
+	"github.com/docker/notary/trustpinning"
+	"github.com/docker/notary/tuf/data"
+
+	"github.com/docker/docker/reference"
+	"github.com/docker/docker/registry"
+)
+
+// trustDirectory is where notary caches trust data on disk, mirroring the
+// directory the CLI's own trust commands use.
+const trustDirectory = "/etc/docker/trust"
+
+// trustedTargetsFetcher retrieves the signed TUF targets metadata for a
+// repository, keyed by tag name. It exists so tests can substitute a fake
+// notary server rather than needing a real one.
+type trustedTargetsFetcher func(ref reference.Named) (map[string]data.FileMeta, error)
+
+// verifyCacheFromTrust checks that manifestDigest, the digest actually
+// resolved for ref, matches the SHA256 a maintainer signed into the
+// repository's TUF targets role. A mismatch (or missing trust data) means
+// ref must not be trusted as a --cache-from source: otherwise a compromised
+// or malicious registry could inject attacker-controlled layers into an
+// otherwise-trusted build via --cache-from.
+func verifyCacheFromTrust(ref reference.NamedTagged, manifestDigest digest.Digest, fetchTargets trustedTargetsFetcher) error {
+	targets, err := fetchTargets(ref)
+	if err != nil {
+		return fmt.Errorf("fetching trust data for %s: %v", ref, err)
+	}
+
+	meta, ok := targets[ref.Tag()]
+	if !ok {
+		return fmt.Errorf("no trust data signed for %s:%s", ref.Name(), ref.Tag())
+	}
+	sha256Hash, ok := meta.Hashes["sha256"]
+	if !ok {
+		return fmt.Errorf("trust data for %s:%s has no sha256 hash", ref.Name(), ref.Tag())
+	}
+
+	signed := digest.NewDigestFromHex("sha256", fmt.Sprintf("%x", sha256Hash))
+	if signed != manifestDigest {
+		return fmt.Errorf("trust verification failed for %s:%s: resolved digest %s does not match signed target %s", ref.Name(), ref.Tag(), manifestDigest, signed)
+	}
+	return nil
+}
+
+// fetchNotaryTargets is the production trustedTargetsFetcher, reading the
+// targets role for ref's repository from the configured notary server.
+func fetchNotaryTargets(ref reference.Named) (map[string]data.FileMeta, error) {
+	repo, err := notaryclient.NewFileCachedNotaryRepository(
+		trustDirectory, ref.Name(), registry.NotaryServer, nil, nil, trustpinning.TrustPinConfig{})
+	if err != nil {
+		return nil, err
+	}
+
+	signedTargets, err := repo.ListTargets()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]data.FileMeta, len(signedTargets))
+	for _, t := range signedTargets {
+		result[t.Name] = t.Target.FileMeta
+	}
+	return result, nil
+}
@@ -0,0 +1,75 @@
+package daemon
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/docker/reference"
+	"github.com/docker/notary/tuf/data"
+)
+
+func mustParseTagged(t *testing.T, name string) reference.NamedTagged {
+	ref, err := reference.ParseNamed(name)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", name, err)
+	}
+	tagged, ok := reference.WithDefaultTag(ref).(reference.NamedTagged)
+	if !ok {
+		t.Fatalf("%s did not parse as a tagged reference", name)
+	}
+	return tagged
+}
+
+func TestVerifyCacheFromTrustMatches(t *testing.T) {
+	ref := mustParseTagged(t, "example.com/foo:latest")
+	manifestDigest := digest.FromBytes([]byte("manifest"))
+	hash := manifestDigest.Hex()
+
+	fetch := func(reference.Named) (map[string]data.FileMeta, error) {
+		return map[string]data.FileMeta{
+			"latest": {Hashes: data.Hashes{"sha256": mustHexDecode(t, hash)}},
+		}, nil
+	}
+
+	if err := verifyCacheFromTrust(ref, manifestDigest, fetch); err != nil {
+		t.Fatalf("expected trust verification to pass, got: %v", err)
+	}
+}
+
+func TestVerifyCacheFromTrustMismatch(t *testing.T) {
+	ref := mustParseTagged(t, "example.com/foo:latest")
+	manifestDigest := digest.FromBytes([]byte("manifest"))
+	signedDigest := digest.FromBytes([]byte("something-else"))
+
+	fetch := func(reference.Named) (map[string]data.FileMeta, error) {
+		return map[string]data.FileMeta{
+			"latest": {Hashes: data.Hashes{"sha256": mustHexDecode(t, signedDigest.Hex())}},
+		}, nil
+	}
+
+	if err := verifyCacheFromTrust(ref, manifestDigest, fetch); err == nil {
+		t.Fatalf("expected trust verification to fail on digest mismatch")
+	}
+}
+
+func TestVerifyCacheFromTrustNoData(t *testing.T) {
+	ref := mustParseTagged(t, "example.com/foo:latest")
+	manifestDigest := digest.FromBytes([]byte("manifest"))
+
+	fetch := func(reference.Named) (map[string]data.FileMeta, error) {
+		return map[string]data.FileMeta{}, nil
+	}
+
+	if err := verifyCacheFromTrust(ref, manifestDigest, fetch); err == nil {
+		t.Fatalf("expected trust verification to fail when no target is signed for the tag")
+	}
+}
+
+func mustHexDecode(t *testing.T, hexStr string) []byte {
+	b, err := hex.DecodeString(hexStr)
+	if err != nil {
+		t.Fatalf("decoding hex: %v", err)
+	}
+	return b
+}
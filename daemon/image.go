@@ -5,14 +5,10 @@ import (
 
 	"github.com/docker/docker/builder"
 	"github.com/docker/docker/image"
+	"github.com/docker/docker/image/cache"
 	"github.com/docker/docker/reference"
-	"github.com/docker/docker/runconfig"
 	containertypes "github.com/docker/engine-api/types/container"
 	"github.com/Sirupsen/logrus"
-	"time"
-	"github.com/docker/docker/layer"
-	"github.com/docker/distribution/digest"
-	"github.com/docker/notary/tuf/data"
 )
 
 // ErrImageDoesNotExist is error returned when no image can be found for a reference.
@@ -77,206 +73,112 @@ func (daemon *Daemon) GetImageOnBuild(name string) (builder.Image, error) {
 	return img, nil
 }
 
-// GetCachedImage returns the most recent created image that is a child
-// of the image with imgID, that had the same config when it was
-// created. nil is returned if a child cannot be found. An error is
-// returned if the parent image cannot be found.
-func (daemon *Daemon) GetCachedImage(imgID image.ID, config *containertypes.Config) (*image.Image, error) {
-	// Loop on the children of the given image and check the config
-	getMatch := func(siblings []image.ID) (*image.Image, error) {
-		var match *image.Image
-		for _, id := range siblings {
-			img, err := daemon.imageStore.Get(id)
-			if err != nil {
-				return nil, fmt.Errorf("unable to find image %q", id)
-			}
-
-			if runconfig.Compare(&img.ContainerConfig, config) {
-				// check for the most up to date match
-				if match == nil || match.Created.Before(img.Created) {
-					match = img
-				}
-			}
-		}
-		return match, nil
-	}
-
-	// In this case, this is `FROM scratch`, which isn't an actual image.
-	if imgID == "" {
-		images := daemon.imageStore.Map()
-		var siblings []image.ID
-		for id, img := range images {
-			if img.Parent == imgID {
-				siblings = append(siblings, id)
-			}
-		}
-		return getMatch(siblings)
-	}
-
-	// find match from child images
-	siblings := daemon.imageStore.Children(imgID)
-	return getMatch(siblings)
+// ImageCacheBuilder abstracts over how a Daemon builds the cache used to
+// answer cache-from lookups during `docker build`, so that the builder can
+// depend on this interface instead of importing the daemon package
+// directly. Alternative image services (e.g. a containerd-backed one) can
+// supply their own implementation.
+//
+// MakeImageCache returns a builder.ImageCache, not the builder.ImageCacheForBuild
+// this package used to return: the builder package's call site and its
+// ImageCache/ImageCacheForBuild types must be renamed to match in lockstep
+// with this one. The builder package isn't part of this tree, so that
+// rename isn't included here -- confirm it lands alongside this change.
+//
+// MakeImageCache also now returns an error alongside the cache, so a
+// --cache-from registry reference that fails content trust verification can
+// be reported as a hard failure instead of a warning; the builder's call
+// site needs to be updated to handle the new return value too.
+type ImageCacheBuilder interface {
+	MakeImageCache(cacheFrom []string, cacheFromInsecure bool) (builder.ImageCache, error)
+
+	// PushImageCache pushes the image identified by imgID to cacheTo as a
+	// build cache manifest, for use as a --cache-from source by a later
+	// build. It is called once per --cache-to reference after a build
+	// completes successfully.
+	PushImageCache(cacheTo string, imgID string) error
 }
 
-type daemonImageCacheForBuild struct {
-	// cacheFromImages here is a map of (provided) names to the actual images it represents
-	cacheFromImages			map[string]*image.Image
-	// cacheFromImageHistories also provides a map back to a historyWithSourceT struct
-	cacheFromImageHistories	map[string]historyWithSourceT
-	// daemon stores a reference to the daemon that backs this cache
-	daemon 					*Daemon
+// daemonImageCache implements builder.ImageCache by delegating to the
+// local/history cache built from the --cache-from images supplied when it
+// was created (plus any --cache-from registry references), then falling
+// back to any registered ImageCachePlugins.
+type daemonImageCache struct {
+	daemon     *Daemon
+	imageCache cache.Source
 }
 
+// MakeImageCache returns a builder.ImageCache that will consider the named
+// cacheFrom images, in addition to the daemon's usual parent/child cache,
+// as sources of cache hits. Each cacheFrom entry is first tried as a local
+// image name; if that fails it's tried as a registry reference instead, in
+// which case it must carry valid trust data unless cacheFromInsecure is
+// set. Entries that resolve as neither are skipped with a warning rather
+// than failing the build, but a registry reference that fails trust
+// verification is a hard error: the operator didn't ask for that check to
+// be skipped, so a failure shouldn't be silently downgraded to "no cache
+// hit".
+func (daemon *Daemon) MakeImageCache(cacheFrom []string, cacheFromInsecure bool) (builder.ImageCache, error) {
+	var localSources []*image.Image
+	sources := cache.Sources{}
 
-func (daemon *Daemon) MakeImageCacheForBuild(cacheFrom []string) builder.ImageCacheForBuild {
-	cache := &daemonImageCacheForBuild{
-		daemon: 			daemon,
-	}
-
-	// for each cacheFrom image, set up the channels & coroutine for scrolling forward through
-	// its history and comparing it to what's being built
 	for _, cacheFromImageName := range cacheFrom {
-		cacheFromImage, err := daemon.GetImage(cacheFromImageName)
-		if err != nil {
-			logrus.Warnf("Could not look up %s for cache resolution, skipping: %s", cacheFromImageName, err)
+		if cacheFromImage, err := daemon.GetImage(cacheFromImageName); err == nil {
+			localSources = append(localSources, cacheFromImage)
 			continue
 		}
 
-		logrus.Infof("I found %s for %s", cacheFromImage.ID().String(), cacheFromImageName)
-		cache.cacheFromImages[cacheFromImageName] = cacheFromImage
-		cache.cacheFromImageHistories[cacheFromImageName] = makeHistoryWithSource(cacheFromImage)
-	}
-
-	return cache
-}
-
-// In the history array, we have pairs of (command, resultingLayerID). What we actually want to be able
-// to compare is pairs of (sourceLayerID, command), and if we have a match, consult resultingLayerID.
-// We also don't directly have source/resultingLayerID, but rather a boolean "did create new layer" flag.
-// Define a struct to store this mapping for convenience.
-type historyWithSourceT struct {
-	// sourceLayerID is the layer on which the command was run. Empty digest if this is the first command or
-	// if nothing has actually been added to the rootfs yet.
-	sourceLayerID		layer.DiffID
-	// cmd is the command which got run on sourceLayerID
-	cmd 				string
-	// resulingLayerID is the result of running cmd on sourceLayerID (might be the same as sourceLayerID)
-	resultingLayerID	layer.DiffID
-	// createdAt is the time the history entry was created
-	createdAt			time.Time
-}
-
-func makeHistoryWithSource(image *image.Image) []historyWithSourceT {
-	// Let's make those structs now
-	historyWithSource := make([]historyWithSourceT, len(image.History))
-	layerIndex := -1
-	for i, h := range image.History {
-
-		// previous is layerIndex from previous iteration
-		if layerIndex == -1 {
-			historyWithSource[i].sourceLayerID = digest.DigestSha256EmptyTar
-		} else {
-			historyWithSource[i].sourceLayerID = image.RootFS.DiffIDs[layerIndex]
+		registrySource, ok, err := daemon.resolveRegistryCacheSource(cacheFromImageName, cacheFromInsecure)
+		if ok && err == nil {
+			sources = append(sources, registrySource)
+			continue
 		}
-
-		// now increment, if needed, and look at the result layer ID
-		if !h.EmptyLayer {
-			layerIndex = layerIndex + 1
+		if trustErr, isTrustErr := err.(ErrCacheFromTrustFailed); isTrustErr {
+			return nil, trustErr
 		}
-		if layerIndex == -1 {
-			historyWithSource[i].resultingLayerID = digest.DigestSha256EmptyTar
+		if err != nil {
+			logrus.Warnf("Could not look up %s for cache resolution, skipping: %s", cacheFromImageName, err)
 		} else {
-			historyWithSource[i].resultingLayerID = image.RootFS.DiffIDs[layerIndex]
+			logrus.Warnf("Could not look up %s for cache resolution, skipping: not a local image or registry reference", cacheFromImageName)
 		}
-
-		// Copy the other history entries over I'm interested in
-		historyWithSource[i].cmd = h.CreatedBy
-		historyWithSource[i].createdAt = h.Created
 	}
 
-	return historyWithSource
-}
-
-func cacheSearchCoroutine(data cacheCoroutineData)  {
-	// Because a layer shasum does not include a hash of the parent in it, we need to compare
-	// *all* of the previous layers we have iterated on with the layers in the image provided to
-	// us in the request. Store a slice into data.cacheFromImage.RootFS.DiffIDs to represent this.
-	var prevStepCachedLayers []layer.DiffID
-
-	historyWithSource := makeHistoryWithSource(data.cacheFromImage)
-
-	for _, h := range historyWithSource {
-		// add prev to the list of all previous layers, if its not empty
-		if h.sourceLayerID != digest.DigestSha256EmptyTar {
-			prevStepCachedLayers = data.cacheFromImage.RootFS.DiffIDs[0:len(prevStepCachedLayers)]
-		}
-
-		req, ok := <-data.reqChan
-		if !ok {
-			// break will finish the goroutine
-			break
-		}
+	sources = append(cache.Sources{cache.New(daemon.imageStore, localSources)}, sources...)
 
-
-		// Compare with all previous layers using our set
-		var matchesLayerIDs bool
-		if len(prevStepCachedLayers) == len(req.prevLayerIDs) {
-			matchesLayerIDs = true
-			for i := 0; i <= len(prevStepCachedLayers); i++ {
-				if prevStepCachedLayers[i] != req.prevLayerIDs[i] {
-					matchesLayerIDs = false
-					break
-				}
-			}
-		} else {
-			matchesLayerIDs = false
-		}
-
-		if req.nextCmd == h.cmd && matchesLayerIDs {
-			data.resChan <- nextCachedLayerResponse{
-				nextLayerID:	h.resultingLayerID,
-				createdAt:		h.createdAt,
-				cachedFrom:		data.cacheFromImageName,
-			}
-		} else {
-			// Send a message telling our caller not to ask us again, then close
-			// the channels
-			data.resChan <- nextCachedLayerResponse{
-				nextLayerID:	"",
-			}
-		}
-	}
+	return &daemonImageCache{
+		daemon:     daemon,
+		imageCache: sources,
+	}, nil
 }
 
 // GetCachedImageOnBuild returns a reference to a cached image whose parent equals `parent`
 // and runconfig equals `cfg`. A cache miss is expected to return an empty ID and a nil error.
-func (cache *daemonImageCacheForBuild) GetCachedImageOnBuild(imgID string, cfg *containertypes.Config) (string, error) {
-	cachedImage, err := cache.daemon.GetCachedImage(image.ID(imgID), cfg)
+//
+// Local and --cache-from lookups are tried first. If both miss, every
+// registered ImageCachePlugin is asked in turn: a plugin is expected to
+// materialize its candidate image into the local store and return its ID,
+// which is then re-checked against cfg's history the same way a
+// --cache-from image would be before it's accepted as a hit.
+func (dc *daemonImageCache) GetCachedImageOnBuild(imgID string, cfg *containertypes.Config) (string, error) {
+	cachedID, err := dc.imageCache.GetCache(imgID, cfg)
 	if err != nil {
 		return "", err
 	}
-	if cachedImage != nil {
-		// We found a cache hit using the old parent image method
-		return cachedImage.ID().String(), nil
+	if cachedID != "" {
+		return cachedID, nil
 	}
-	// We didn't find a cache hit using that method. Explore cacheFrom images for matching history
-	parentImage, err := cache.daemon.GetImage(image.ID(imgID))
+
+	pluginImageID, err := askCachePlugins(imgID, cfg)
 	if err != nil {
 		return "", err
 	}
-	parentImageHistory := makeHistoryWithSource(parentImage)
-
-	// For each thing we are caching from, see if it matches parentImageHistory
-	type matchStruct struct {
-
+	if pluginImageID == "" {
+		return "", nil
 	}
-	matches := make([]matchStruct, 0, len(cache.cacheFromImages))
-	for cacheFromName, cacheFromImage := range cache.cacheFromImages {
-		if len(cache.cacheFromImageHistories[cacheFromName]) <= len(parentImageHistory) {
-			// This won't really work - we have more steps than the cache from image has, so
-			// there is no possibility of a match.
-			continue
-		}
+
+	pluginImage, err := dc.daemon.GetImage(pluginImageID)
+	if err != nil {
+		return "", err
 	}
+	return cache.New(dc.daemon.imageStore, []*image.Image{pluginImage}).GetCache(imgID, cfg)
 }
-
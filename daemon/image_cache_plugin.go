@@ -1,36 +1,210 @@
 package daemon
 
 import (
-    "github.com/docker/docker/pkg/plugins"
-    containertypes "github.com/docker/engine-api/types/container"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/plugins"
+	containertypes "github.com/docker/engine-api/types/container"
+	"github.com/Sirupsen/logrus"
 )
 
 const (
-    WantsCachedImage = "ImageCachePlugin.WantsCachedImage"
-)
+	// imageCachePluginCapability is the capability plugins register under
+	// to be consulted as a build cache source.
+	imageCachePluginCapability = "ImageCachePlugin"
 
-type WantsCachedImageRequest struct (
-    // The parent image we are looking for a child of...
-    ParentImageId string `json:"ParentImageId,omitempty"`
+	// WantsCachedImage is the plugin RPC method called to ask a plugin for
+	// a cache hit.
+	WantsCachedImage = "ImageCachePlugin.WantsCachedImage"
 
-    // ...which matches this config
-    ContainerConfig containertypes.Config `json:"ContianerConfig,omitempty"`
+	// pluginCallTimeout bounds how long we'll wait on a single plugin
+	// before treating the call as failed, so a slow remote cache can't
+	// stall `docker build`.
+	pluginCallTimeout = 10 * time.Second
+
+	// pluginBreakerThreshold is the number of consecutive failures (errors
+	// or timeouts) after which a plugin is skipped for pluginBreakerCooldown.
+	pluginBreakerThreshold = 3
+	pluginBreakerCooldown  = time.Minute
 )
 
-type WantsCachedImageResponse struct (
-    // The image id that was found, or nil if it didn't find one
-    ImageId string `json:"ImageId,omitempty"`
+type WantsCachedImageRequest struct {
+	// The parent image we are looking for a child of...
+	ParentImageId string `json:"ParentImageId,omitempty"`
+
+	// ...which matches this config
+	ContainerConfig containertypes.Config `json:"ContainerConfig,omitempty"`
+}
 
-    // Err stores a message in case there's an error
+type WantsCachedImageResponse struct {
+	// The image id that was found, or empty if it didn't find one
+	ImageId string `json:"ImageId,omitempty"`
+
+	// Err stores a message in case there's an error
 	Err string `json:"Err,omitempty"`
-)
+}
 
 type ImageCachePlugin interface {
-    // Name returns the registered plugin name
+	// Name returns the registered plugin name
 	Name() string
 
-    // WantsCachedImage tells the plugin that we want an image specified by our request.
-    // The plugin is responsible for using the docker API to put this image in the local image store.
-    // It then tells us whether or not it found such a thing, and what the ID is if it did.
-    WantsCachedImage(*WantsCachedImageRequest) (*WantsCachedImageResponse, error)
-}
\ No newline at end of file
+	// WantsCachedImage tells the plugin that we want an image specified by our request.
+	// The plugin is responsible for using the docker API to put this image in the local image store.
+	// It then tells us whether or not it found such a thing, and what the ID is if it did.
+	WantsCachedImage(*WantsCachedImageRequest) (*WantsCachedImageResponse, error)
+}
+
+// cachePluginAdapter turns a generic *plugins.Client into an ImageCachePlugin,
+// following the same activation/call protocol as the other pkg/plugins
+// consumers (volume and network drivers).
+type cachePluginAdapter struct {
+	name   string
+	client *plugins.Client
+
+	breaker pluginBreaker
+}
+
+func (a *cachePluginAdapter) Name() string {
+	return a.name
+}
+
+// wantsCachedImageResult carries a.client.Call's outcome from the goroutine
+// that runs it back to WantsCachedImage, so the timeout path below never
+// touches a variable the goroutine might still be writing.
+type wantsCachedImageResult struct {
+	resp *WantsCachedImageResponse
+	err  error
+}
+
+func (a *cachePluginAdapter) WantsCachedImage(req *WantsCachedImageRequest) (*WantsCachedImageResponse, error) {
+	if a.breaker.open() {
+		return nil, fmt.Errorf("image cache plugin %s: circuit open after repeated failures", a.name)
+	}
+
+	// Buffered so the goroutine can always deliver its result and exit on
+	// its own, whether or not the timeout below fires first. plugins.Client
+	// has no way to cancel an in-flight Call, so a plugin that never
+	// responds still leaks this goroutine until the call eventually returns
+	// or errors -- but its result is only ever read through resultCh, never
+	// written to a variable this function also touches, so there's no data
+	// race with the timeout path.
+	resultCh := make(chan wantsCachedImageResult, 1)
+	go func() {
+		var resp WantsCachedImageResponse
+		err := a.client.Call(WantsCachedImage, req, &resp)
+		resultCh <- wantsCachedImageResult{resp: &resp, err: err}
+	}()
+
+	var result wantsCachedImageResult
+	select {
+	case result = <-resultCh:
+	case <-time.After(pluginCallTimeout):
+		a.breaker.recordFailure()
+		return nil, fmt.Errorf("image cache plugin %s: timed out after %s", a.name, pluginCallTimeout)
+	}
+
+	if result.err != nil {
+		a.breaker.recordFailure()
+		return nil, result.err
+	}
+	if result.resp.Err != "" {
+		a.breaker.recordFailure()
+		return nil, errors.New(result.resp.Err)
+	}
+
+	a.breaker.recordSuccess()
+	return result.resp, nil
+}
+
+// pluginBreaker is a small consecutive-failure circuit breaker: after
+// pluginBreakerThreshold calls in a row fail (error or timeout), the plugin
+// is skipped for pluginBreakerCooldown rather than tried again immediately.
+type pluginBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func (b *pluginBreaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= pluginBreakerThreshold && time.Now().Before(b.openUntil)
+}
+
+func (b *pluginBreaker) recordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= pluginBreakerThreshold {
+		b.openUntil = time.Now().Add(pluginBreakerCooldown)
+	}
+}
+
+func (b *pluginBreaker) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+// cachePluginAdapters keeps one adapter per plugin name across lookups, so
+// each plugin's breaker state carries over from one build step to the next.
+var (
+	cachePluginAdaptersMu sync.Mutex
+	cachePluginAdapters   = make(map[string]*cachePluginAdapter)
+)
+
+// imageCachePlugins returns an ImageCachePlugin adapter for every currently
+// activated plugin that implements the ImageCachePlugin capability.
+func imageCachePlugins() ([]ImageCachePlugin, error) {
+	pl, err := plugins.GetAll(imageCachePluginCapability)
+	if err != nil {
+		return nil, err
+	}
+
+	cachePluginAdaptersMu.Lock()
+	defer cachePluginAdaptersMu.Unlock()
+
+	cachePlugins := make([]ImageCachePlugin, 0, len(pl))
+	for _, p := range pl {
+		adapter, ok := cachePluginAdapters[p.Name()]
+		if !ok || adapter.client != p.Client() {
+			adapter = &cachePluginAdapter{
+				name:   p.Name(),
+				client: p.Client(),
+			}
+			cachePluginAdapters[p.Name()] = adapter
+		}
+		cachePlugins = append(cachePlugins, adapter)
+	}
+	return cachePlugins, nil
+}
+
+// askCachePlugins asks each registered ImageCachePlugin, in turn, whether it
+// knows of an image satisfying (parentImageID, cfg). The first plugin to
+// return a non-empty image ID wins; plugin errors and timeouts are logged
+// and otherwise treated as a miss from that plugin.
+func askCachePlugins(parentImageID string, cfg *containertypes.Config) (string, error) {
+	cachePlugins, err := imageCachePlugins()
+	if err != nil {
+		return "", err
+	}
+
+	req := &WantsCachedImageRequest{
+		ParentImageId:   parentImageID,
+		ContainerConfig: *cfg,
+	}
+	for _, p := range cachePlugins {
+		resp, err := p.WantsCachedImage(req)
+		if err != nil {
+			logrus.Warnf("image cache plugin %s failed, skipping: %s", p.Name(), err)
+			continue
+		}
+		if resp.ImageId != "" {
+			return resp.ImageId, nil
+		}
+	}
+	return "", nil
+}
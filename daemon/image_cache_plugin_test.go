@@ -0,0 +1,73 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/docker/pkg/plugins"
+	containertypes "github.com/docker/engine-api/types/container"
+)
+
+// fakeCachePluginServer answers WantsCachedImage with a fixed response,
+// simulating a remote plugin that pulled a candidate image into the local
+// store and is reporting its ID back.
+func fakeCachePluginServer(t *testing.T, resp WantsCachedImageResponse) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+WantsCachedImage, func(w http.ResponseWriter, r *http.Request) {
+		var req WantsCachedImageRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("decoding request: %v", err)
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestCachePluginAdapterWantsCachedImage(t *testing.T) {
+	srv := fakeCachePluginServer(t, WantsCachedImageResponse{ImageId: "sha256:cachehit"})
+	defer srv.Close()
+
+	client, err := plugins.NewClient(srv.URL, nil)
+	if err != nil {
+		t.Fatalf("creating plugin client: %v", err)
+	}
+	adapter := &cachePluginAdapter{name: "fake", client: client}
+
+	resp, err := adapter.WantsCachedImage(&WantsCachedImageRequest{
+		ParentImageId:   "sha256:parent",
+		ContainerConfig: containertypes.Config{Cmd: []string{"/bin/sh", "-c", "echo hi"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.ImageId != "sha256:cachehit" {
+		t.Fatalf("expected cache hit sha256:cachehit, got %q", resp.ImageId)
+	}
+}
+
+func TestCachePluginAdapterErrorOpensBreaker(t *testing.T) {
+	srv := fakeCachePluginServer(t, WantsCachedImageResponse{Err: "boom"})
+	defer srv.Close()
+
+	client, err := plugins.NewClient(srv.URL, nil)
+	if err != nil {
+		t.Fatalf("creating plugin client: %v", err)
+	}
+	adapter := &cachePluginAdapter{name: "fake", client: client}
+
+	for i := 0; i < pluginBreakerThreshold; i++ {
+		if _, err := adapter.WantsCachedImage(&WantsCachedImageRequest{}); err == nil {
+			t.Fatalf("expected plugin error to surface")
+		}
+	}
+
+	if !adapter.breaker.open() {
+		t.Fatalf("expected breaker to be open after %d consecutive failures", pluginBreakerThreshold)
+	}
+
+	if _, err := adapter.WantsCachedImage(&WantsCachedImageRequest{}); err == nil {
+		t.Fatalf("expected a circuit-open error, got nil")
+	}
+}
@@ -0,0 +1,261 @@
+// Package cache provides a build cache that matches against the build
+// history of a set of candidate images, rather than requiring a direct
+// parent/child relationship in the local image store.
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/runconfig"
+	containertypes "github.com/docker/engine-api/types/container"
+)
+
+// Source is satisfied by anything that can answer a cache-from lookup,
+// letting callers combine local, history-based and registry-backed caches.
+type Source interface {
+	GetCache(parentID string, cfg *containertypes.Config) (string, error)
+}
+
+// Sources tries each Source in order and returns the first cache hit.
+type Sources []Source
+
+// GetCache implements Source.
+func (ss Sources) GetCache(parentID string, cfg *containertypes.Config) (string, error) {
+	for _, s := range ss {
+		id, err := s.GetCache(parentID, cfg)
+		if err != nil {
+			return "", err
+		}
+		if id != "" {
+			return id, nil
+		}
+	}
+	return "", nil
+}
+
+// LocalImageCache looks for a cache hit among images that are a direct
+// child of a parent image in the local image store. This is the original,
+// cheaper notion of build cache: it only ever considers images the daemon
+// already produced itself.
+type LocalImageCache struct {
+	store image.Store
+}
+
+// NewLocal returns a LocalImageCache backed by store.
+func NewLocal(store image.Store) *LocalImageCache {
+	return &LocalImageCache{store: store}
+}
+
+// GetCache returns the ID of the most recently created image that is a
+// child of parentID and has the same container config as cfg, or "" if
+// none is found. parentID is "" for `FROM scratch`.
+func (lic *LocalImageCache) GetCache(parentID string, cfg *containertypes.Config) (string, error) {
+	var siblings []image.ID
+	if parentID == "" {
+		for id, img := range lic.store.Map() {
+			if img.Parent == image.ID(parentID) {
+				siblings = append(siblings, id)
+			}
+		}
+	} else {
+		siblings = lic.store.Children(image.ID(parentID))
+	}
+
+	var match *image.Image
+	for _, id := range siblings {
+		img, err := lic.store.Get(id)
+		if err != nil {
+			return "", fmt.Errorf("unable to find image %q", id)
+		}
+		if !runconfig.Compare(&img.ContainerConfig, cfg) {
+			continue
+		}
+		// check for the most up to date match
+		if match == nil || match.Created.Before(img.Created) {
+			match = img
+		}
+	}
+	if match == nil {
+		return "", nil
+	}
+	return match.ID().String(), nil
+}
+
+// ImageCache answers cache-from lookups by first consulting a
+// LocalImageCache, then walking the build history of a fixed set of source
+// images in lockstep with the history built so far.
+type ImageCache struct {
+	localImageCache *LocalImageCache
+	store           image.Store
+	sources         []*image.Image
+}
+
+// New returns an ImageCache that looks for cache hits among sources, falling
+// back to a LocalImageCache over store. store is also used to map a matched
+// layer chain back to an image ID.
+func New(store image.Store, sources []*image.Image) *ImageCache {
+	return &ImageCache{
+		localImageCache: NewLocal(store),
+		store:           store,
+		sources:         sources,
+	}
+}
+
+// historyEntry pairs up a build history entry with the layer it ran on top
+// of (sourceLayerID) and the layer it produced (resultingLayerID) -- the raw
+// image.History / RootFS.DiffIDs slices don't give us that directly, since
+// empty-layer history entries (ENV, LABEL, ...) don't consume an entry from
+// RootFS.DiffIDs.
+type historyEntry struct {
+	sourceLayerID    layer.DiffID
+	resultingLayerID layer.DiffID
+	// resultingLayerIndex is the index into the owning image's
+	// RootFS.DiffIDs of resultingLayerID, or -1 if no layer has been
+	// produced yet (we're still looking at the empty-layer prefix).
+	resultingLayerIndex int
+	cmd                 string
+	createdAt           time.Time
+}
+
+// historyWithSource walks img.History and img.RootFS.DiffIDs together,
+// producing one historyEntry per history entry.
+func historyWithSource(img *image.Image) []historyEntry {
+	entries := make([]historyEntry, len(img.History))
+	layerIndex := -1
+	for i, h := range img.History {
+		if layerIndex == -1 {
+			entries[i].sourceLayerID = digest.DigestSha256EmptyTar
+		} else {
+			entries[i].sourceLayerID = img.RootFS.DiffIDs[layerIndex]
+		}
+
+		if !h.EmptyLayer {
+			layerIndex++
+		}
+
+		if layerIndex == -1 {
+			entries[i].resultingLayerID = digest.DigestSha256EmptyTar
+		} else {
+			entries[i].resultingLayerID = img.RootFS.DiffIDs[layerIndex]
+		}
+		entries[i].resultingLayerIndex = layerIndex
+
+		entries[i].cmd = h.CreatedBy
+		entries[i].createdAt = h.Created
+	}
+	return entries
+}
+
+// historiesMatch reports whether every step in want (the history built so
+// far) is matched by the corresponding step in have, comparing both the
+// layer the step ran on top of and the command that was run.
+func historiesMatch(want, have []historyEntry) bool {
+	if len(want) != len(have) {
+		return false
+	}
+	for i := range want {
+		if want[i].sourceLayerID != have[i].sourceLayerID || want[i].cmd != have[i].cmd {
+			return false
+		}
+	}
+	return true
+}
+
+// cmdString turns a build step's config into the same string form used in
+// image.History.CreatedBy, so the two can be compared directly.
+func cmdString(cfg *containertypes.Config) string {
+	return strings.Join(cfg.Cmd, " ")
+}
+
+// GetCache looks for an image to use as the cache for the next build step on
+// top of parentID, given cfg. parentID is "" for `FROM scratch`. Each source
+// image's history is required to agree with parentID's own history for every
+// step already taken, and then to have one more step whose command matches
+// cfg. A cache miss returns ("", nil); a cache hit returns the ID of an
+// image in store whose layer chain matches the one found in history.
+func (ic *ImageCache) GetCache(parentID string, cfg *containertypes.Config) (string, error) {
+	imgID, err := ic.localImageCache.GetCache(parentID, cfg)
+	if err != nil {
+		return "", err
+	}
+	if imgID != "" {
+		return imgID, nil
+	}
+
+	var parentHistory []historyEntry
+	if parentID != "" {
+		parent, err := ic.store.Get(image.ID(parentID))
+		if err != nil {
+			return "", err
+		}
+		parentHistory = historyWithSource(parent)
+	}
+
+	for _, source := range ic.sources {
+		sourceHistory := historyWithSource(source)
+		if len(sourceHistory) <= len(parentHistory) {
+			// The cache-from image has taken no more steps than we
+			// have, so it cannot contain our next step.
+			continue
+		}
+		if !historiesMatch(parentHistory, sourceHistory[:len(parentHistory)]) {
+			continue
+		}
+
+		next := sourceHistory[len(parentHistory)]
+		if next.cmd != cmdString(cfg) {
+			continue
+		}
+
+		if next.resultingLayerIndex == -1 {
+			// This step (e.g. ENV, LABEL) produced no new layer, so there
+			// is no layer chain to map back to an image ID: matching it
+			// is a no-op cache hit, not a reason to resolve some
+			// unrelated image whose chain happens to share the same
+			// (empty) prefix.
+			continue
+		}
+
+		imgID := ic.imageIDForLayerChain(source.RootFS.DiffIDs[:next.resultingLayerIndex+1])
+		if imgID != "" {
+			return imgID, nil
+		}
+	}
+
+	return "", nil
+}
+
+// imageIDForLayerChain scans the image store for an image whose own
+// RootFS.DiffIDs, truncated to len(chain), equals chain exactly. chain must
+// be non-empty: an empty chain would vacuously match every image.
+func (ic *ImageCache) imageIDForLayerChain(chain []layer.DiffID) string {
+	if len(chain) == 0 {
+		return ""
+	}
+	for id, img := range ic.store.Map() {
+		if len(img.RootFS.DiffIDs) < len(chain) {
+			continue
+		}
+		if diffIDsEqual(img.RootFS.DiffIDs[:len(chain)], chain) {
+			return id.String()
+		}
+	}
+	return ""
+}
+
+func diffIDsEqual(a, b []layer.DiffID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	containertypes "github.com/docker/engine-api/types/container"
+)
+
+// fakeStore is a minimal image.Store that only knows how to Get and Map
+// the images it was seeded with -- everything ImageCache's history lookup
+// needs. Children always reports none, and Create stores nothing.
+type fakeStore struct {
+	images map[image.ID]*image.Image
+}
+
+func newFakeStore(images ...*image.Image) *fakeStore {
+	s := &fakeStore{images: make(map[image.ID]*image.Image)}
+	for i, img := range images {
+		s.images[image.ID(diffIDForIndex(i))] = img
+	}
+	return s
+}
+
+func diffIDForIndex(i int) string {
+	return digest.Digest(digest.FromBytes([]byte{byte(i)})).String()
+}
+
+func (s *fakeStore) Create(config []byte) (image.ID, error)        { return "", nil }
+func (s *fakeStore) Delete(id image.ID) ([]layer.Metadata, error)  { return nil, nil }
+func (s *fakeStore) Search(partialID string) (image.ID, error)     { return "", nil }
+func (s *fakeStore) SetParent(id, parent image.ID) error           { return nil }
+func (s *fakeStore) GetParent(id image.ID) (image.ID, error)       { return "", nil }
+func (s *fakeStore) SetLastUpdated(id image.ID) error              { return nil }
+func (s *fakeStore) GetLastUpdated(id image.ID) (time.Time, error) { return time.Time{}, nil }
+func (s *fakeStore) Children(id image.ID) []image.ID               { return nil }
+func (s *fakeStore) Heads() map[image.ID]*image.Image               { return s.images }
+func (s *fakeStore) Len() int                                       { return len(s.images) }
+
+func (s *fakeStore) Get(id image.ID) (*image.Image, error) {
+	img, ok := s.images[id]
+	if !ok {
+		return nil, ErrImageNotFound{id}
+	}
+	return img, nil
+}
+
+func (s *fakeStore) Map() map[image.ID]*image.Image {
+	return s.images
+}
+
+// ErrImageNotFound is returned by fakeStore.Get for an unknown ID.
+type ErrImageNotFound struct{ id image.ID }
+
+func (e ErrImageNotFound) Error() string { return "no such image: " + e.id.String() }
+
+func layerDiffID(seed byte) layer.DiffID {
+	return layer.DiffID(digest.FromBytes([]byte{seed}))
+}
+
+// buildImage constructs an *image.Image with History/RootFS.DiffIDs that are
+// consistent with each other, the way the builder would produce: an
+// EmptyLayer history entry for each of emptyLayerCmds, followed by one
+// history entry (consuming one entry from diffIDs) for each of runCmds.
+func buildImage(emptyLayerCmds []string, runCmds []string, diffIDs []layer.DiffID) *image.Image {
+	img := &image.Image{
+		RootFS: &image.RootFS{Type: "layers", DiffIDs: diffIDs},
+	}
+	for _, cmd := range emptyLayerCmds {
+		img.History = append(img.History, image.History{CreatedBy: cmd, EmptyLayer: true, Created: time.Now()})
+	}
+	for _, cmd := range runCmds {
+		img.History = append(img.History, image.History{CreatedBy: cmd, Created: time.Now()})
+	}
+	return img
+}
+
+func TestGetCacheFromScratch(t *testing.T) {
+	diffIDs := []layer.DiffID{layerDiffID(1)}
+	source := buildImage(nil, []string{"/bin/sh -c echo hi"}, diffIDs)
+	store := newFakeStore(source)
+
+	ic := New(store, []*image.Image{source})
+
+	cfg := &containertypes.Config{Cmd: []string{"/bin/sh -c echo hi"}}
+
+	id, err := ic.GetCache("", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id == "" {
+		t.Fatalf("expected a cache hit for FROM scratch, got a miss")
+	}
+}
+
+func TestGetCacheSkipsEmptyLayerInstructions(t *testing.T) {
+	diffIDs := []layer.DiffID{layerDiffID(1)}
+	source := buildImage([]string{"/bin/sh -c #(nop) ENV foo=bar", "/bin/sh -c #(nop) LABEL a=b"}, []string{"/bin/sh -c touch /x"}, diffIDs)
+	store := newFakeStore(source)
+
+	ic := New(store, []*image.Image{source})
+
+	// Matching the first two (empty-layer) steps should not require a real
+	// layer to exist yet.
+	cfg := &containertypes.Config{Cmd: []string{"/bin/sh -c #(nop) ENV foo=bar"}}
+	id, err := ic.GetCache("", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != "" {
+		t.Fatalf("ENV steps produce no new image, expected a miss, got %q", id)
+	}
+}
+
+func TestGetCacheParentLongerThanSource(t *testing.T) {
+	parentDiffIDs := []layer.DiffID{layerDiffID(1), layerDiffID(2)}
+	parent := buildImage(nil, []string{"/bin/sh -c one", "/bin/sh -c two"}, parentDiffIDs)
+
+	sourceDiffIDs := []layer.DiffID{layerDiffID(1)}
+	source := buildImage(nil, []string{"/bin/sh -c one"}, sourceDiffIDs)
+
+	store := newFakeStore(parent, source)
+
+	ic := New(store, []*image.Image{source})
+
+	cfg := &containertypes.Config{Cmd: []string{"/bin/sh -c three"}}
+	id, err := ic.GetCache(imageIDOf(store, parent), cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != "" {
+		t.Fatalf("source image has fewer steps than the parent, expected a miss, got %q", id)
+	}
+}
+
+func imageIDOf(store *fakeStore, img *image.Image) string {
+	for id, candidate := range store.images {
+		if candidate == img {
+			return id.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,238 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/reference"
+	containertypes "github.com/docker/engine-api/types/container"
+)
+
+// cacheManifestEntry is the flattened (parent chain, cmd, resulting layer)
+// tuple PushCacheManifest writes and RegistryCache.GetCache reads back, one
+// per build history step that produced a layer.
+type cacheManifestEntry struct {
+	ParentChain  []layer.DiffID `json:"parentChain"`
+	Cmd          string         `json:"cmd"`
+	ResultDiffID layer.DiffID   `json:"resultDiffID"`
+}
+
+// RegistryCache answers cache-from lookups against a cache manifest index
+// pushed to a registry, pulling only the one layer blob a hit actually
+// requires rather than the whole image.
+type RegistryCache struct {
+	store      image.Store
+	layerStore layer.Store
+	repo       distribution.Repository
+	ref        reference.NamedTagged
+	digest     digest.Digest
+}
+
+// NewRegistry returns a RegistryCache that resolves cache entries from the
+// manifest at manifestDigest via repo, registering any pulled layer with
+// layerStore and materializing a hit as a new image in store.
+//
+// manifestDigest must be resolved by the caller (and, unless the caller is
+// operating in an explicitly insecure mode, verified against trust data)
+// before this is called: fetchEntries always reads the manifest by this
+// digest rather than re-resolving ref's tag, so the manifest actually read
+// is provably the one the caller resolved and verified.
+func NewRegistry(store image.Store, layerStore layer.Store, repo distribution.Repository, ref reference.NamedTagged, manifestDigest digest.Digest) *RegistryCache {
+	return &RegistryCache{store: store, layerStore: layerStore, repo: repo, ref: ref, digest: manifestDigest}
+}
+
+// GetCache fetches the cache manifest index for rc.ref and looks for an
+// entry whose parent chain and cmd match parentID/cfg, pulling only the one
+// layer blob a hit requires and registering it as a new image.
+func (rc *RegistryCache) GetCache(parentID string, cfg *containertypes.Config) (string, error) {
+	var parentChain []layer.DiffID
+	var parent *image.Image
+	if parentID != "" {
+		var err error
+		parent, err = rc.store.Get(image.ID(parentID))
+		if err != nil {
+			return "", err
+		}
+		parentChain = parent.RootFS.DiffIDs
+	}
+
+	entries, err := rc.fetchEntries()
+	if err != nil {
+		return "", err
+	}
+
+	cmd := cmdString(cfg)
+	for _, entry := range entries {
+		if entry.ResultDiffID == digest.DigestSha256EmptyTar {
+			// An empty-layer step (ENV, LABEL, ...) produced no new layer,
+			// so there is nothing for materialize to pull or resolve to --
+			// symmetric with ImageCache.GetCache skipping these on the
+			// local/history-based lookup path. historyToCacheEntries
+			// doesn't push these, but older cache images may still have
+			// them.
+			continue
+		}
+		if !diffIDsEqual(entry.ParentChain, parentChain) || entry.Cmd != cmd {
+			continue
+		}
+		return rc.materialize(parent, entry)
+	}
+	return "", nil
+}
+
+// fetchEntries pulls and decodes the cache manifest index at rc.digest. The
+// index is stored as the manifest's config blob, content-addressed like any
+// other blob, rather than as a manifest annotation: annotations are an OCI
+// manifest concept this registry client's schema2 manifest type doesn't
+// have.
+func (rc *RegistryCache) fetchEntries() ([]cacheManifestEntry, error) {
+	ctx := context.Background()
+
+	ms, err := rc.repo.Manifests(ctx)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := ms.Get(ctx, rc.digest)
+	if err != nil {
+		return nil, fmt.Errorf("fetching cache-from %s manifest %s: %v", rc.ref, rc.digest, err)
+	}
+	m, ok := manifest.(*schema2.DeserializedManifest)
+	if !ok {
+		return nil, fmt.Errorf("cache-from %s: unsupported manifest type %T, not a build cache image", rc.ref, manifest)
+	}
+
+	raw, err := rc.repo.Blobs(ctx).Get(ctx, m.Config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("cache-from %s: fetching cache index: %v", rc.ref, err)
+	}
+	var entries []cacheManifestEntry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, fmt.Errorf("cache-from %s: %s is not a build cache image: %v", rc.ref, rc.digest, err)
+	}
+	return entries, nil
+}
+
+// materialize registers entry's layer locally (skipping the pull entirely
+// if a layer or image with that chain is already present) and stores a new
+// image representing parent + entry, returning its ID.
+func (rc *RegistryCache) materialize(parent *image.Image, entry cacheManifestEntry) (string, error) {
+	chain := append(append([]layer.DiffID{}, entry.ParentChain...), entry.ResultDiffID)
+	for id, img := range rc.store.Map() {
+		if diffIDsEqual(img.RootFS.DiffIDs, chain) {
+			// Already have an image with this exact layer chain locally;
+			// no need to pull anything.
+			return id.String(), nil
+		}
+	}
+
+	var parentChainID layer.ChainID
+	if len(entry.ParentChain) > 0 {
+		parentChainID = layer.CreateChainID(entry.ParentChain)
+	}
+
+	// l's reference is balanced below: released if we bail out before
+	// creating the image, but otherwise left alone on success, since it
+	// now belongs to the image we're about to create -- the same way a
+	// puller hands a layer's reference off to the image it commits rather
+	// than releasing it immediately, so the layer isn't garbage collected
+	// out from under an image that still references its chain.
+	l, err := rc.layerStore.Get(layer.CreateChainID(chain))
+	if err != nil {
+		// Not present locally under any image either -- pull just this
+		// one blob and register it on top of the parent chain.
+		ctx := context.Background()
+		rd, err := rc.repo.Blobs(ctx).Open(ctx, digest.Digest(entry.ResultDiffID))
+		if err != nil {
+			return "", err
+		}
+		defer rd.Close()
+
+		l, err = rc.layerStore.Register(rd, parentChainID)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	newImage := image.Image{
+		RootFS: &image.RootFS{Type: "layers", DiffIDs: chain},
+	}
+	var history []image.History
+	if parent != nil {
+		newImage.Parent = parent.ID()
+		history = append(history, parent.History...)
+	}
+	newImage.History = append(history, image.History{CreatedBy: entry.Cmd})
+
+	config, err := json.Marshal(newImage)
+	if err != nil {
+		layer.ReleaseAndLog(rc.layerStore, l)
+		return "", err
+	}
+	id, err := rc.store.Create(config)
+	if err != nil {
+		layer.ReleaseAndLog(rc.layerStore, l)
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// PushCacheManifest pushes img's build history to ref as a cache manifest
+// index, so a later build elsewhere can use ref as a --cache-from source.
+// The index is pushed as the manifest's config blob itself rather than as
+// an annotation, since schema2 manifests have no annotations field.
+func PushCacheManifest(repo distribution.Repository, ref reference.NamedTagged, img *image.Image) error {
+	raw, err := json.Marshal(historyToCacheEntries(img))
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	configDesc, err := repo.Blobs(ctx).Put(ctx, schema2.MediaTypeImageConfig, raw)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config:    configDesc,
+	})
+	if err != nil {
+		return err
+	}
+
+	ms, err := repo.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = ms.Put(ctx, manifest, distribution.WithTag(ref.Tag()))
+	return err
+}
+
+// historyToCacheEntries turns img's build history into the flattened
+// (parent chain, cmd, resulting diff ID) tuples cacheManifestEntry stores,
+// one per history step that produced a layer.
+func historyToCacheEntries(img *image.Image) []cacheManifestEntry {
+	entries := make([]cacheManifestEntry, 0, len(img.History))
+	for i, h := range historyWithSource(img) {
+		if img.History[i].EmptyLayer {
+			// This step (e.g. ENV, LABEL) produced no new layer: there is
+			// no new layer for a later build to pull, so there is
+			// nothing useful to record.
+			continue
+		}
+		entries = append(entries, cacheManifestEntry{
+			ParentChain:  img.RootFS.DiffIDs[:h.resultingLayerIndex],
+			Cmd:          h.cmd,
+			ResultDiffID: h.resultingLayerID,
+		})
+	}
+	return entries
+}